@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// Builder implements packer.Builder and builds a VM image by attaching to,
+// provisioning and snapshotting an existing registered VirtualBox VM (or, if
+// clone_vm is set, a throwaway linked clone of it).
+type Builder struct {
+	config Config
+	runner multistep.Runner
+}
+
+func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
+	warnings, errs := b.config.Prepare(raws...)
+	if errs != nil {
+		return nil, warnings, errs
+	}
+
+	return nil, warnings, nil
+}
+
+func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	driver, err := vboxcommon.NewDriver()
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating VirtualBox driver: %s", err)
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("driver", driver)
+	state.Put("hook", hook)
+	state.Put("ui", ui)
+	state.Put("vmName", b.config.VMName)
+
+	steps := []multistep.Step{
+		// Inserted before the attach/start sequence: operate on a linked
+		// clone of vm_name instead of mutating it directly.
+		&StepCloneVM{
+			CloneVM:        b.config.CloneVM,
+			CloneName:      b.config.CloneName,
+			CloneSnapshot:  b.config.CloneSnapshot,
+			KeepRegistered: b.config.KeepRegistered,
+		},
+		&StepAttachSnapshot{
+			AttachSnapshot:       b.config.AttachSnapshot,
+			TargetSnapshot:       b.config.TargetSnapshot,
+			TargetSnapshotParent: b.config.TargetSnapshotParent,
+			KeepRegistered:       b.config.KeepRegistered,
+			CloneVM:              b.config.CloneVM,
+		},
+		&vboxcommon.StepRun{},
+		&vboxcommon.StepTypeBootCommand{},
+		&communicator.StepConnect{},
+		&common.StepProvision{},
+		&vboxcommon.StepShutdown{},
+		// Creates target_snapshot once the VM has been shut down. It is
+		// already a child of target_snapshot_parent because StepAttachSnapshot
+		// booted the VM from target_snapshot_parent before provisioning ran.
+		&StepCreateSnapshot{
+			TargetSnapshot:       b.config.TargetSnapshot,
+			DeleteTargetSnapshot: b.config.DeleteTargetSnapshot,
+		},
+		// Inserted after the snapshot-create step: prune older siblings of
+		// target_snapshot per the retention policy.
+		&StepPruneSnapshots{
+			TargetSnapshot: b.config.TargetSnapshot,
+			RetainCount:    b.config.SnapshotRetainCount,
+			RetainPattern:  b.config.SnapshotRetainPattern,
+			PruneChildren:  b.config.SnapshotPruneChildren,
+		},
+	}
+
+	if !b.config.SkipExport {
+		steps = append(steps, &vboxcommon.StepExport{})
+	}
+
+	b.runner = common.NewRunner(steps, b.config.PackerConfig, ui)
+	b.runner.Run(ctx, state)
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return nil, rawErr.(error)
+	}
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, errors.New("Build was cancelled.")
+	}
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return nil, errors.New("Build was halted.")
+	}
+
+	artifactRaw, ok := state.GetOk("artifact")
+	if !ok {
+		return nil, nil
+	}
+
+	return artifactRaw.(packer.Artifact), nil
+}
@@ -6,12 +6,14 @@ package vm
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
 	"time"
 
 	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/common/bootcommand"
+	"github.com/hashicorp/packer/common/uuid"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/packer"
 	"github.com/hashicorp/packer/template/interpolate"
@@ -73,6 +75,12 @@ type Config struct {
 	//   by the provisioners. This is handy if only an export shall be created and no
 	//   further snapshot is required.
 	TargetSnapshot string `mapstructure:"target_snapshot" required:"false"`
+	// Default to `attach_snapshot`. The name of
+	//   the snapshot `target_snapshot` shall be created as a child of. This lets
+	//   a new snapshot be branched off any node in the tree rather than only the
+	//   snapshot the builder is attached to. The snapshot must already exist on
+	//   `vm_name`.
+	TargetSnapshotParent string `mapstructure:"target_snapshot_parent" required:"false"`
 	// Defaults to `false`. If set to `true`,
 	//   overwrite an existing `target_snapshot`. Otherwise the builder will yield an
 	//   error if the specified target snapshot already exists.
@@ -86,6 +94,40 @@ type Config struct {
 	//   not export the VM. Useful if the builder should be applied again on the created
 	//   target snapshot.
 	SkipExport bool `mapstructure:"skip_export" required:"false"`
+	// Defaults to `false`. When set to `true`, the
+	//   builder will not operate on `vm_name` directly but on a linked clone
+	//   registered under `clone_name`. The clone is created from
+	//   `clone_snapshot` with `VBoxManage clonevm --options link`, which lets
+	//   multiple `packer build` invocations run in parallel against the same
+	//   source VM without fighting over its snapshot tree.
+	CloneVM bool `mapstructure:"clone_vm" required:"false"`
+	// Default to `null/empty`, in which case a
+	//   name of the form `packer-clonevm-<vm_name>-<uuid>` is generated. The
+	//   name the linked clone shall be registered under. Only used when
+	//   `clone_vm` is `true`.
+	CloneName string `mapstructure:"clone_name" required:"false"`
+	// Default to `null/empty`, in which case the
+	//   VM's current snapshot is used. The name of the snapshot on `vm_name`
+	//   that the linked clone is created from. Only used when `clone_vm` is
+	//   `true`.
+	CloneSnapshot string `mapstructure:"clone_snapshot" required:"false"`
+	// Default to `0`, which disables pruning. The
+	//   number of snapshots matching `snapshot_retain_pattern` to keep, siblings
+	//   of `target_snapshot` under its parent. Once `target_snapshot` is created,
+	//   the builder deletes the oldest matching siblings beyond this count.
+	//   Not supported together with `clone_vm`, since pruning would operate on
+	//   the throwaway clone's snapshots rather than `vm_name`'s.
+	SnapshotRetainCount int `mapstructure:"snapshot_retain_count" required:"false"`
+	// Default to `*`, matching every snapshot. A
+	//   glob pattern used to select which sibling snapshots are subject to
+	//   `snapshot_retain_count`. Snapshots that don't match the pattern are
+	//   never pruned.
+	SnapshotRetainPattern string `mapstructure:"snapshot_retain_pattern" required:"false"`
+	// Defaults to `false`. If a snapshot selected
+	//   for pruning has children of its own, the builder will refuse to delete it
+	//   unless this is set to `true`, in which case its children are deleted
+	//   first, recursively.
+	SnapshotPruneChildren bool `mapstructure:"snapshot_prune_children" required:"false"`
 
 	ctx interpolate.Context
 }
@@ -164,6 +206,51 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 		c.GuestAdditionsSHA256 = strings.ToLower(c.GuestAdditionsSHA256)
 	}
 
+	if c.CloneVM {
+		if c.CloneName == "" {
+			c.CloneName = fmt.Sprintf("packer-clonevm-%s-%s", c.VMName, uuid.TimeOrderedUUID())
+		}
+		if c.CloneName == c.VMName {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("clone_name cannot be the same as vm_name"))
+		}
+	} else if c.CloneName != "" || c.CloneSnapshot != "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("clone_name and clone_snapshot are only valid when clone_vm is true"))
+	}
+
+	if c.SnapshotRetainCount > 0 {
+		if c.TargetSnapshot == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("snapshot_retain_count requires target_snapshot to be set"))
+		}
+		if c.CloneVM {
+			// StepPruneSnapshots runs against vmName, which StepCloneVM has
+			// already repointed at the throwaway linked clone by the time
+			// pruning runs. Pruning the clone's tree right before it's
+			// deleted would silently do nothing to vm_name, so reject the
+			// combination instead of accepting a retention policy that never
+			// takes effect.
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("snapshot_retain_count is not supported together with clone_vm: it would prune the throwaway clone's snapshots instead of vm_name's"))
+		}
+		if c.SnapshotRetainPattern == "" {
+			c.SnapshotRetainPattern = "*"
+		}
+		if _, err := filepath.Match(c.SnapshotRetainPattern, ""); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("snapshot_retain_pattern is not a valid glob pattern: %s", err))
+		}
+	} else if c.SnapshotRetainCount < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("snapshot_retain_count must not be negative"))
+	}
+
+	if c.TargetSnapshotParent != "" && c.TargetSnapshot == "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("target_snapshot_parent requires target_snapshot to be set"))
+	}
+
 	// Warnings
 	var warnings []string
 	if c.TargetSnapshot == "" && c.SkipExport {
@@ -197,7 +284,18 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 				attachSnapshot = snapshotTree.GetCurrentSnapshot()
 				log.Printf("VM %s is currently attached to snapshot: %s/%s", c.VMName, attachSnapshot.Name, attachSnapshot.UUID)
 			}
-			if c.AttachSnapshot != "" {
+			if c.CloneVM {
+				// attach_snapshot, target_snapshot and target_snapshot_parent
+				// are resolved against the linked clone created by
+				// StepCloneVM, not against vm_name, and the clone does not
+				// exist yet during Prepare. They can't be validated here;
+				// StepAttachSnapshot and StepCreateSnapshot fail the build at
+				// runtime if the names don't resolve on the clone.
+				warnings = append(warnings,
+					"clone_vm is true: attach_snapshot, target_snapshot and target_snapshot_parent\n"+
+						"are resolved against the linked clone at build time and were not validated\n"+
+						"against vm_name's snapshot tree.")
+			} else if c.AttachSnapshot != "" {
 				log.Printf("Checking configuration attach_snapshot [%s]", c.AttachSnapshot)
 				if nil == snapshotTree {
 					errs = packer.MultiErrorAppend(errs, fmt.Errorf("No snapshots defined on VM %s. Unable to attach to %s", c.VMName, c.AttachSnapshot))
@@ -212,30 +310,68 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 					}
 				}
 			}
-			if c.TargetSnapshot != "" {
+			if c.CloneVM && c.CloneSnapshot != "" {
+				log.Printf("Checking configuration clone_snapshot [%s]", c.CloneSnapshot)
+				if nil == snapshotTree {
+					errs = packer.MultiErrorAppend(errs, fmt.Errorf("No snapshots defined on VM %s. Unable to clone from %s", c.VMName, c.CloneSnapshot))
+				} else {
+					snapshots := snapshotTree.GetSnapshotsByName(c.CloneSnapshot)
+					if 0 >= len(snapshots) {
+						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Snapshot %s does not exist on VM %s", c.CloneSnapshot, c.VMName))
+					} else if 1 < len(snapshots) {
+						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Multiple Snapshots with name %s exist on VM %s", c.CloneSnapshot, c.VMName))
+					}
+				}
+			}
+			if !c.CloneVM && c.TargetSnapshotParent != "" {
+				// Validated whether or not target_snapshot is also set, so a
+				// missing or ambiguous target_snapshot_parent is reported
+				// alongside the target_snapshot requirement error above.
+				// StepAttachSnapshot boots the VM from target_snapshot_parent
+				// only when target_snapshot is set too.
+				log.Printf("Checking configuration target_snapshot_parent [%s]", c.TargetSnapshotParent)
+				if nil == snapshotTree {
+					errs = packer.MultiErrorAppend(errs, fmt.Errorf("No snapshots defined on VM %s. Unable to use %s as target_snapshot_parent", c.VMName, c.TargetSnapshotParent))
+				} else {
+					parents := snapshotTree.GetSnapshotsByName(c.TargetSnapshotParent)
+					if 0 >= len(parents) {
+						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Snapshot %s does not exist on VM %s. Unable to use it as target_snapshot_parent", c.TargetSnapshotParent, c.VMName))
+					} else if 1 < len(parents) {
+						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Multiple Snapshots with name %s exist on VM %s", c.TargetSnapshotParent, c.VMName))
+					}
+				}
+			}
+			if c.TargetSnapshot != "" && !c.CloneVM {
 				log.Printf("Checking configuration target_snapshot [%s]", c.TargetSnapshot)
 				if nil == snapshotTree {
 					log.Printf("Currently no snapshots defined in VM %s", c.VMName)
 				} else {
-					if c.TargetSnapshot == attachSnapshot.Name {
-						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s cannot be the same as the snapshot to which the builder shall attach: %s", c.TargetSnapshot, attachSnapshot.Name))
+					targetParent := attachSnapshot
+					if c.TargetSnapshotParent != "" {
+						if parents := snapshotTree.GetSnapshotsByName(c.TargetSnapshotParent); len(parents) == 1 {
+							targetParent = parents[0]
+						}
+					}
+
+					if nil != targetParent && c.TargetSnapshot == targetParent.Name {
+						errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s cannot be the same as its target_snapshot_parent: %s", c.TargetSnapshot, targetParent.Name))
 					} else {
 						snapshots := snapshotTree.GetSnapshotsByName(c.TargetSnapshot)
 						if 0 < len(snapshots) {
-							if nil == attachSnapshot {
+							if nil == targetParent {
 								panic("Internal error. Expecting a handle to a VBoxSnapshot")
 							}
 							isChild := false
 							for _, snapshot := range snapshots {
-								log.Printf("Checking if target snaphot %s/%s is child of %s/%s", snapshot.Name, snapshot.UUID, attachSnapshot.Name, attachSnapshot.UUID)
-								isChild = nil != snapshot.Parent && snapshot.Parent.UUID == attachSnapshot.UUID
+								log.Printf("Checking if target snaphot %s/%s descends from %s/%s", snapshot.Name, snapshot.UUID, targetParent.Name, targetParent.UUID)
+								isChild = isChild || isDescendantOf(snapshot, targetParent)
 							}
 							if !isChild {
-								errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s already exists and is not a direct child of %s", c.TargetSnapshot, attachSnapshot.Name))
+								errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s already exists and does not descend from %s", c.TargetSnapshot, targetParent.Name))
 							} else if !c.DeleteTargetSnapshot {
-								errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s already exists as direct child of %s for VM %s. Use force_delete_snapshot = true to overwrite snapshot",
+								errs = packer.MultiErrorAppend(errs, fmt.Errorf("Target snapshot %s already exists as a descendant of %s for VM %s. Use force_delete_snapshot = true to overwrite snapshot",
 									c.TargetSnapshot,
-									attachSnapshot.Name,
+									targetParent.Name,
 									c.VMName))
 							}
 						} else {
@@ -253,3 +389,15 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 
 	return warnings, nil
 }
+
+// isDescendantOf reports whether snapshot descends from ancestor at any
+// depth, walking the full parent chain rather than only comparing the
+// immediate parent.
+func isDescendantOf(snapshot, ancestor *vboxcommon.VBoxSnapshot) bool {
+	for parent := snapshot.Parent; parent != nil; parent = parent.Parent {
+		if parent.UUID == ancestor.UUID {
+			return true
+		}
+	}
+	return false
+}
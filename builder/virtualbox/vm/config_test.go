@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// discardUi is a packer.Ui that swallows Say/Error calls. It embeds
+// packer.Ui so it satisfies the interface without implementing every
+// method; steps under test only call Say and Error.
+type discardUi struct {
+	packer.Ui
+}
+
+func (discardUi) Say(string)   {}
+func (discardUi) Error(string) {}
+
+// prepareErrors runs c.Prepare and returns its error messages, tolerating
+// (and stripping out) the "Failed creating VirtualBox driver" error that
+// Prepare appends in any environment without VBoxManage installed, since
+// that failure is unrelated to the config-level checks under test here.
+func prepareErrors(t *testing.T, c *Config, raws ...interface{}) []string {
+	t.Helper()
+
+	_, err := c.Prepare(raws...)
+	if err == nil {
+		return nil
+	}
+	merr, ok := err.(*packer.MultiError)
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	var msgs []string
+	for _, e := range merr.Errors {
+		if strings.Contains(e.Error(), "Failed creating VirtualBox driver") {
+			continue
+		}
+		msgs = append(msgs, e.Error())
+	}
+	return msgs
+}
+
+func containsError(msgs []string, substr string) bool {
+	for _, m := range msgs {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigPrepare_CloneVMDefaultName(t *testing.T) {
+	var c Config
+	errs := prepareErrors(t, &c, map[string]interface{}{
+		"vm_name":      "test-vm",
+		"clone_vm":     true,
+		"ssh_username": "packer",
+	})
+
+	if c.CloneName == "" {
+		t.Fatal("expected a default clone_name to be generated when clone_vm is true")
+	}
+	if !strings.HasPrefix(c.CloneName, "packer-clonevm-test-vm-") {
+		t.Fatalf("unexpected default clone_name: %s", c.CloneName)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestConfigPrepare_CloneNameCollidesWithVMName(t *testing.T) {
+	var c Config
+	errs := prepareErrors(t, &c, map[string]interface{}{
+		"vm_name":    "test-vm",
+		"clone_vm":   true,
+		"clone_name": "test-vm",
+	})
+
+	if !containsError(errs, "clone_name cannot be the same as vm_name") {
+		t.Fatalf("expected a clone_name collision error, got: %v", errs)
+	}
+}
+
+func TestConfigPrepare_CloneFieldsRequireCloneVM(t *testing.T) {
+	var c Config
+	errs := prepareErrors(t, &c, map[string]interface{}{
+		"vm_name":        "test-vm",
+		"clone_snapshot": "base",
+	})
+
+	if !containsError(errs, "clone_name and clone_snapshot are only valid when clone_vm is true") {
+		t.Fatalf("expected a clone_vm requirement error, got: %v", errs)
+	}
+}
+
+func TestConfigPrepare_TargetSnapshotParentRequiresTargetSnapshot(t *testing.T) {
+	var c Config
+	errs := prepareErrors(t, &c, map[string]interface{}{
+		"vm_name":                "test-vm",
+		"target_snapshot_parent": "base",
+	})
+
+	if !containsError(errs, "target_snapshot_parent requires target_snapshot to be set") {
+		t.Fatalf("expected a target_snapshot_parent requirement error, got: %v", errs)
+	}
+}
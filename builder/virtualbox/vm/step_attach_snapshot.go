@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepAttachSnapshot attaches the VM to AttachSnapshot before it is started,
+// and reverts to the snapshot the VM was attached to before the build unless
+// KeepRegistered is set. The revert is skipped when CloneVM is set, since in
+// that case vmName is the linked clone StepCloneVM.Cleanup is about to
+// delete, and restoring it first is pointless.
+//
+// When TargetSnapshot and TargetSnapshotParent are both set, TargetSnapshotParent
+// is used as the attach point instead: target_snapshot must become a child
+// of target_snapshot_parent, and the only way to make that true without
+// discarding the build's work is to boot and provision from
+// target_snapshot_parent in the first place, rather than restoring to it
+// after provisioning has already happened. The override is gated on
+// TargetSnapshot being set too, matching Config.Prepare, which rejects
+// target_snapshot_parent without target_snapshot.
+type StepAttachSnapshot struct {
+	AttachSnapshot       string
+	TargetSnapshot       string
+	TargetSnapshotParent string
+	KeepRegistered       bool
+	CloneVM              bool
+
+	priorSnapshot string
+}
+
+func (s *StepAttachSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	tree, err := driver.LoadSnapshots(vmName)
+	if err != nil {
+		err := fmt.Errorf("Error loading snapshots for VM %s: %s", vmName, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if tree != nil {
+		if current := tree.GetCurrentSnapshot(); current != nil {
+			s.priorSnapshot = current.Name
+		}
+	}
+
+	attachTo := s.AttachSnapshot
+	if s.TargetSnapshot != "" && s.TargetSnapshotParent != "" {
+		attachTo = s.TargetSnapshotParent
+	}
+	if attachTo == "" {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Attaching to snapshot %s on VM %s...", attachTo, vmName))
+	if err := driver.VBoxManage("snapshot", vmName, "restore", attachTo); err != nil {
+		err := fmt.Errorf("Error attaching to snapshot %s: %s", attachTo, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepAttachSnapshot) Cleanup(state multistep.StateBag) {
+	if s.KeepRegistered || s.CloneVM || s.priorSnapshot == "" {
+		return
+	}
+
+	driverRaw, ok := state.GetOk("driver")
+	if !ok {
+		return
+	}
+	driver := driverRaw.(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	ui.Say(fmt.Sprintf("Reverting VM %s to snapshot %s...", vmName, s.priorSnapshot))
+	if err := driver.VBoxManage("snapshot", vmName, "restore", s.priorSnapshot); err != nil {
+		ui.Error(fmt.Sprintf("Error reverting to snapshot %s: %s", s.priorSnapshot, err))
+	}
+}
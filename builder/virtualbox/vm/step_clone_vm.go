@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepCloneVM creates a throwaway linked clone of the source VM so that the
+// remainder of the build can attach, start and snapshot the clone instead of
+// mutating the source VM. It runs before the existing attach/start sequence
+// and is a no-op unless CloneVM is set.
+type StepCloneVM struct {
+	CloneVM        bool
+	CloneName      string
+	CloneSnapshot  string
+	KeepRegistered bool
+
+	created bool
+}
+
+func (s *StepCloneVM) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if !s.CloneVM {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	cloneSnapshot := s.CloneSnapshot
+	if cloneSnapshot == "" {
+		// A linked clone must be based on a snapshot; fall back to the VM's
+		// current snapshot to honor clone_snapshot's documented default.
+		tree, err := driver.LoadSnapshots(vmName)
+		if err != nil {
+			err := fmt.Errorf("Error loading snapshots for VM %s: %s", vmName, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if tree == nil {
+			err := fmt.Errorf("VM %s has no snapshots. clone_vm requires a snapshot to link the clone to; set clone_snapshot or create one first", vmName)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		cloneSnapshot = tree.GetCurrentSnapshot().Name
+	}
+
+	ui.Say(fmt.Sprintf("Creating linked clone %s of %s at snapshot %s...", s.CloneName, vmName, cloneSnapshot))
+
+	args := []string{"clonevm", vmName, "--name", s.CloneName, "--snapshot", cloneSnapshot, "--options", "link", "--register"}
+
+	if err := driver.VBoxManage(args...); err != nil {
+		err := fmt.Errorf("Error creating linked clone %s: %s", s.CloneName, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.created = true
+
+	// From here on the rest of the build operates on the clone, not the
+	// source VM.
+	state.Put("vmName", s.CloneName)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCloneVM) Cleanup(state multistep.StateBag) {
+	if !s.CloneVM || s.KeepRegistered || !s.created {
+		return
+	}
+
+	driverRaw, ok := state.GetOk("driver")
+	if !ok {
+		return
+	}
+	driver := driverRaw.(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Unregistering and deleting linked clone %s...", s.CloneName))
+	if err := driver.VBoxManage("unregistervm", s.CloneName, "--delete"); err != nil {
+		ui.Error(fmt.Sprintf("Error deleting linked clone %s: %s", s.CloneName, err))
+	}
+}
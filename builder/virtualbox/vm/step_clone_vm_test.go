@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"context"
+	"testing"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// fakeCloneDriver embeds vboxcommon.Driver so it satisfies the interface
+// without implementing every method; only the ones StepCloneVM calls are
+// overridden.
+type fakeCloneDriver struct {
+	vboxcommon.Driver
+
+	tree      *vboxcommon.VBoxSnapshot
+	cloneArgs []string
+}
+
+func (d *fakeCloneDriver) LoadSnapshots(vmName string) (*vboxcommon.VBoxSnapshot, error) {
+	return d.tree, nil
+}
+
+func (d *fakeCloneDriver) VBoxManage(args ...string) error {
+	d.cloneArgs = args
+	return nil
+}
+
+func newTestState(driver vboxcommon.Driver, vmName string) *multistep.BasicStateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("driver", driver)
+	state.Put("ui", packer.Ui(discardUi{}))
+	state.Put("vmName", vmName)
+	return state
+}
+
+func TestStepCloneVM_FallsBackToCurrentSnapshot(t *testing.T) {
+	// A single-node tree whose only snapshot is the current one.
+	current := &vboxcommon.VBoxSnapshot{Name: "current-snap", UUID: "uuid-1", IsCurrent: true}
+	driver := &fakeCloneDriver{tree: current}
+
+	step := &StepCloneVM{CloneVM: true, CloneName: "clone-vm"}
+	state := newTestState(driver, "source-vm")
+
+	if action := step.Run(context.Background(), state); action == multistep.ActionHalt {
+		t.Fatalf("unexpected halt: %v", state.Get("error"))
+	}
+
+	snapshotArg := ""
+	for i, arg := range driver.cloneArgs {
+		if arg == "--snapshot" && i+1 < len(driver.cloneArgs) {
+			snapshotArg = driver.cloneArgs[i+1]
+		}
+	}
+	if snapshotArg != "current-snap" {
+		t.Fatalf("expected clonevm to be called with --snapshot current-snap, got args: %v", driver.cloneArgs)
+	}
+
+	if got := state.Get("vmName").(string); got != "clone-vm" {
+		t.Fatalf("expected vmName to be repointed at the clone, got %s", got)
+	}
+}
+
+func TestStepCloneVM_NoSnapshotsHalts(t *testing.T) {
+	driver := &fakeCloneDriver{tree: nil}
+	step := &StepCloneVM{CloneVM: true, CloneName: "clone-vm"}
+	state := newTestState(driver, "source-vm")
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatal("expected halt when source VM has no snapshots to clone from")
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("expected an error to be set in state")
+	}
+}
+
+func TestStepCloneVM_NoopWhenCloneVMDisabled(t *testing.T) {
+	driver := &fakeCloneDriver{}
+	step := &StepCloneVM{CloneVM: false}
+	state := newTestState(driver, "source-vm")
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatal("expected a no-op when clone_vm is false")
+	}
+	if driver.cloneArgs != nil {
+		t.Fatalf("expected no VBoxManage call, got args: %v", driver.cloneArgs)
+	}
+}
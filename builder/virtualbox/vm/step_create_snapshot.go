@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// StepCreateSnapshot creates TargetSnapshot once the VM has been shut down,
+// deleting a pre-existing snapshot of the same name first when
+// DeleteTargetSnapshot is set. It is a no-op unless TargetSnapshot is set.
+//
+// TargetSnapshot ends up a child of TargetSnapshotParent because
+// StepAttachSnapshot already attached and booted the VM from
+// TargetSnapshotParent before provisioning ran; this step only has to take
+// the snapshot of the VM's current (provisioned) state.
+type StepCreateSnapshot struct {
+	TargetSnapshot       string
+	DeleteTargetSnapshot bool
+}
+
+func (s *StepCreateSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.TargetSnapshot == "" {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	tree, err := driver.LoadSnapshots(vmName)
+	if err != nil {
+		err := fmt.Errorf("Error loading snapshots for VM %s: %s", vmName, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if tree != nil && len(tree.GetSnapshotsByName(s.TargetSnapshot)) > 0 {
+		if !s.DeleteTargetSnapshot {
+			err := fmt.Errorf("Target snapshot %s already exists on VM %s", s.TargetSnapshot, vmName)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		ui.Say(fmt.Sprintf("Deleting existing snapshot %s on VM %s...", s.TargetSnapshot, vmName))
+		if err := driver.VBoxManage("snapshot", vmName, "delete", s.TargetSnapshot); err != nil {
+			err := fmt.Errorf("Error deleting snapshot %s: %s", s.TargetSnapshot, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Creating snapshot %s on VM %s...", s.TargetSnapshot, vmName))
+	if err := driver.VBoxManage("snapshot", vmName, "take", s.TargetSnapshot); err != nil {
+		err := fmt.Errorf("Error creating snapshot %s: %s", s.TargetSnapshot, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCreateSnapshot) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// snapshotUUIDRe matches the SnapshotUUID[-N]="..." lines emitted by
+// `VBoxManage snapshot <vm> list --machinereadable`, in the order VBoxManage
+// walks the snapshot tree. VBoxSnapshot itself carries no timestamp, so this
+// listing is the only authoritative, deterministic ordering available for
+// deciding which sibling snapshots are oldest. UUIDs, unlike snapshot names,
+// are guaranteed unique, so ordering is keyed by UUID rather than name.
+var snapshotUUIDRe = regexp.MustCompile(`(?m)^SnapshotUUID(?:-[\d-]+)?="(.*)"$`)
+
+// snapshotCreationOrder returns, for each snapshot UUID on vmName, the index
+// at which it first appears in `VBoxManage snapshot list --machinereadable`.
+// Lower indexes were created earlier.
+func snapshotCreationOrder(driver vboxcommon.Driver, vmName string) (map[string]int, error) {
+	stdout, _, err := driver.VBoxManageWithOutput("snapshot", vmName, "list", "--machinereadable")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing snapshots for VM %s: %s", vmName, err)
+	}
+
+	order := map[string]int{}
+	for _, match := range snapshotUUIDRe.FindAllStringSubmatch(stdout, -1) {
+		uuid := match[1]
+		if _, ok := order[uuid]; !ok {
+			order[uuid] = len(order)
+		}
+	}
+	return order, nil
+}
+
+// StepPruneSnapshots runs after TargetSnapshot has been created and enforces
+// a retention policy over its sibling snapshots, deleting the oldest matches
+// beyond RetainCount. It is a no-op unless RetainCount is greater than zero.
+type StepPruneSnapshots struct {
+	TargetSnapshot string
+	RetainCount    int
+	RetainPattern  string
+	PruneChildren  bool
+}
+
+func (s *StepPruneSnapshots) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	if s.RetainCount <= 0 {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(vboxcommon.Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	tree, err := driver.LoadSnapshots(vmName)
+	if err != nil {
+		err := fmt.Errorf("Error loading snapshots for VM %s: %s", vmName, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	targets := tree.GetSnapshotsByName(s.TargetSnapshot)
+	if len(targets) != 1 {
+		// Target snapshot vanished or is ambiguous; nothing sane to prune
+		// against, so leave the tree alone.
+		return multistep.ActionContinue
+	}
+	target := targets[0]
+	if target.Parent == nil {
+		return multistep.ActionContinue
+	}
+
+	var siblings []*vboxcommon.VBoxSnapshot
+	for _, sibling := range target.Parent.Children {
+		if sibling.UUID == target.UUID {
+			continue
+		}
+		matched, err := filepath.Match(s.RetainPattern, sibling.Name)
+		if err != nil {
+			err := fmt.Errorf("Error matching snapshot_retain_pattern %s: %s", s.RetainPattern, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if matched {
+			siblings = append(siblings, sibling)
+		}
+	}
+
+	if len(siblings) <= s.RetainCount {
+		return multistep.ActionContinue
+	}
+
+	order, err := snapshotCreationOrder(driver, vmName)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	for _, sibling := range siblings {
+		if _, ok := order[sibling.UUID]; !ok {
+			err := fmt.Errorf("Snapshot %s/%s is missing from VBoxManage's snapshot listing; refusing to guess its age", sibling.Name, sibling.UUID)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	sort.Slice(siblings, func(i, j int) bool {
+		return order[siblings[i].UUID] < order[siblings[j].UUID]
+	})
+
+	toPrune := siblings[:len(siblings)-s.RetainCount]
+	for _, snapshot := range toPrune {
+		if len(snapshot.Children) > 0 && !s.PruneChildren {
+			ui.Say(fmt.Sprintf("Skipping snapshot %s: has children and snapshot_prune_children is false", snapshot.Name))
+			continue
+		}
+
+		if err := s.deleteSnapshotTree(driver, ui, vmName, snapshot); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// deleteSnapshotTree deletes snapshot, first recursively deleting its
+// children when snapshot_prune_children allowed the walk to reach it.
+func (s *StepPruneSnapshots) deleteSnapshotTree(driver vboxcommon.Driver, ui packer.Ui, vmName string, snapshot *vboxcommon.VBoxSnapshot) error {
+	for _, child := range snapshot.Children {
+		if err := s.deleteSnapshotTree(driver, ui, vmName, child); err != nil {
+			return err
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Pruning snapshot %s...", snapshot.Name))
+	if err := driver.VBoxManage("snapshot", vmName, "delete", snapshot.Name); err != nil {
+		return fmt.Errorf("Error deleting snapshot %s: %s", snapshot.Name, err)
+	}
+	return nil
+}
+
+func (s *StepPruneSnapshots) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,226 @@
+package vm
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	vboxcommon "github.com/hashicorp/packer/builder/virtualbox/common"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+// fakePruneDriver embeds vboxcommon.Driver so it satisfies the interface
+// without implementing every method; only the ones StepPruneSnapshots calls
+// are overridden.
+type fakePruneDriver struct {
+	vboxcommon.Driver
+
+	tree       *vboxcommon.VBoxSnapshot
+	listOutput string
+	deleted    []string
+}
+
+func (d *fakePruneDriver) LoadSnapshots(vmName string) (*vboxcommon.VBoxSnapshot, error) {
+	return d.tree, nil
+}
+
+func (d *fakePruneDriver) VBoxManageWithOutput(args ...string) (string, string, error) {
+	return d.listOutput, "", nil
+}
+
+func (d *fakePruneDriver) VBoxManage(args ...string) error {
+	if len(args) == 4 && args[0] == "snapshot" && args[2] == "delete" {
+		d.deleted = append(d.deleted, args[3])
+	}
+	return nil
+}
+
+// snap creates a VBoxSnapshot and, if parent is non-nil, links it as one of
+// parent's children.
+func snap(name, uuid string, parent *vboxcommon.VBoxSnapshot) *vboxcommon.VBoxSnapshot {
+	s := &vboxcommon.VBoxSnapshot{Name: name, UUID: uuid, Parent: parent}
+	if parent != nil {
+		parent.Children = append(parent.Children, s)
+	}
+	return s
+}
+
+// machineReadableList builds a `VBoxManage snapshot list --machinereadable`
+// style listing establishing creation order, oldest first, for the given
+// UUIDs. Real output nests child snapshots under "-N-M" suffixed keys, but
+// snapshotCreationOrder only cares about first-appearance order of
+// SnapshotUUID(-suffix)="uuid" lines, so a flat numbering exercises the same
+// regex path as a nested one.
+func machineReadableList(uuidsOldestFirst ...string) string {
+	var b strings.Builder
+	for i, uuid := range uuidsOldestFirst {
+		suffix := ""
+		if i > 0 {
+			suffix = "-" + strconv.Itoa(i)
+		}
+		b.WriteString("SnapshotUUID" + suffix + "=\"" + uuid + "\"\n")
+	}
+	return b.String()
+}
+
+func TestSnapshotCreationOrder(t *testing.T) {
+	output := `SnapshotUUID="root-uuid"
+SnapshotName="root"
+SnapshotUUID-1="child1-uuid"
+SnapshotName-1="child1"
+SnapshotUUID-1-1="grandchild-uuid"
+SnapshotName-1-1="grandchild"
+SnapshotUUID-2="child2-uuid"
+SnapshotName-2="child2"
+`
+	driver := &fakePruneDriver{listOutput: output}
+
+	order, err := snapshotCreationOrder(driver, "test-vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]int{
+		"root-uuid":       0,
+		"child1-uuid":     1,
+		"grandchild-uuid": 2,
+		"child2-uuid":     3,
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("got %v, want %v", order, want)
+	}
+}
+
+func runPrune(t *testing.T, driver *fakePruneDriver, step *StepPruneSnapshots) {
+	t.Helper()
+
+	state := newTestState(driver, "test-vm")
+	if action := step.Run(context.Background(), state); action == multistep.ActionHalt {
+		if err, ok := state.GetOk("error"); ok {
+			t.Fatalf("unexpected halt: %s", err)
+		}
+		t.Fatal("unexpected halt")
+	}
+}
+
+func TestStepPruneSnapshots_RetainCountBoundary(t *testing.T) {
+	parent := snap("parent", "parent-uuid", nil)
+	snap("target", "target-uuid", parent)
+	sib1 := snap("sib1", "sib1-uuid", parent)
+	sib2 := snap("sib2", "sib2-uuid", parent)
+
+	driver := &fakePruneDriver{
+		tree:       parent,
+		listOutput: machineReadableList("parent-uuid", sib1.UUID, sib2.UUID, "target-uuid"),
+	}
+
+	step := &StepPruneSnapshots{
+		TargetSnapshot: "target",
+		RetainCount:    2,
+		RetainPattern:  "*",
+	}
+
+	runPrune(t, driver, step)
+
+	if len(driver.deleted) != 0 {
+		t.Fatalf("expected no deletions when len(siblings) <= RetainCount, got: %v", driver.deleted)
+	}
+}
+
+func TestStepPruneSnapshots_PatternFiltering(t *testing.T) {
+	parent := snap("parent", "parent-uuid", nil)
+	snap("target", "target-uuid", parent)
+
+	keep1 := snap("keep-1", "keep-1-uuid", parent)
+	keep2 := snap("keep-2", "keep-2-uuid", parent)
+	keep3 := snap("keep-3", "keep-3-uuid", parent)
+	other := snap("other-1", "other-1-uuid", parent)
+
+	driver := &fakePruneDriver{
+		tree: parent,
+		// Oldest to newest: keep1, keep2, keep3, other, target.
+		listOutput: machineReadableList(keep1.UUID, keep2.UUID, keep3.UUID, other.UUID, "target-uuid"),
+	}
+
+	step := &StepPruneSnapshots{
+		TargetSnapshot: "target",
+		RetainCount:    1,
+		RetainPattern:  "keep-*",
+	}
+
+	runPrune(t, driver, step)
+
+	want := []string{"keep-1", "keep-2"}
+	if !reflect.DeepEqual(driver.deleted, want) {
+		t.Fatalf("got deleted %v, want %v (other-1 must never be touched by a keep-* pattern)", driver.deleted, want)
+	}
+}
+
+func TestStepPruneSnapshots_SkipsChildrenUnlessPruneChildren(t *testing.T) {
+	parent := snap("parent", "parent-uuid", nil)
+	snap("target", "target-uuid", parent)
+
+	withChild := snap("with-child", "with-child-uuid", parent)
+	child := snap("child", "child-uuid", withChild)
+	alone := snap("alone", "alone-uuid", parent)
+	newest := snap("newest", "newest-uuid", parent)
+
+	driver := &fakePruneDriver{
+		tree:       parent,
+		listOutput: machineReadableList(withChild.UUID, child.UUID, alone.UUID, newest.UUID, "target-uuid"),
+	}
+
+	step := &StepPruneSnapshots{
+		TargetSnapshot: "target",
+		RetainCount:    1,
+		RetainPattern:  "*",
+	}
+
+	runPrune(t, driver, step)
+
+	if containsStr(driver.deleted, "with-child") {
+		t.Fatalf("expected with-child to be skipped without snapshot_prune_children, got: %v", driver.deleted)
+	}
+	if !containsStr(driver.deleted, "alone") {
+		t.Fatalf("expected alone to be pruned, got: %v", driver.deleted)
+	}
+}
+
+func TestStepPruneSnapshots_CascadesWhenPruneChildrenSet(t *testing.T) {
+	parent := snap("parent", "parent-uuid", nil)
+	snap("target", "target-uuid", parent)
+
+	withChild := snap("with-child", "with-child-uuid", parent)
+	child := snap("child", "child-uuid", withChild)
+	newest := snap("newest", "newest-uuid", parent)
+
+	driver := &fakePruneDriver{
+		tree:       parent,
+		listOutput: machineReadableList(withChild.UUID, child.UUID, newest.UUID, "target-uuid"),
+	}
+
+	step := &StepPruneSnapshots{
+		TargetSnapshot: "target",
+		RetainCount:    1,
+		RetainPattern:  "*",
+		PruneChildren:  true,
+	}
+
+	runPrune(t, driver, step)
+
+	want := []string{"child", "with-child"}
+	if !reflect.DeepEqual(driver.deleted, want) {
+		t.Fatalf("expected children to be deleted before their parent, got: %v", driver.deleted)
+	}
+}
+
+func containsStr(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}